@@ -31,6 +31,18 @@ import (
 	"unicode"
 	"math"
 	"bufio"
+	"flag"
+	"sync"
+	"time"
+	"sort"
+	"encoding/json"
+	"encoding/csv"
+	"strconv"
+	"math/rand"
+	"runtime"
+	"context"
+	"os/signal"
+	"syscall"
 )
 
 
@@ -43,9 +55,11 @@ import (
 
 // Describes directories used
 type Configuration struct {
-	Src      string            // Benchmarks directory
-	Stats    string            // Data (results) directory
-	Bin      string            // Binaries (compiled benchmarks)
+	Src            string        // Benchmarks directory
+	Stats          string        // Data (results) directory
+	Bin            string        // Binaries (compiled benchmarks)
+	CompileTimeout time.Duration // Max duration to allow a single compile to run
+	EvalTimeout    time.Duration // Max duration to allow a single evaluation to run
 }
 
 // Describes a benchmark
@@ -54,8 +68,34 @@ type Benchmark struct {
 	Path        string
 	Runtime     float64
 	Uncertainty float64
+	Samples     []float64 // Individual samples (ns) backing Runtime/Uncertainty
+	Compiler    string    // Compiler used for the most recent evaluation
+	Repeats     int       // Repeat count used for the most recent evaluation
+	ExpectFail  bool      // Set by a "benchmark:expect-fail" directive or an expect_fail.txt entry
+	ExpectIssue string    // The "issue=..." argument of that directive or entry, if any
 }
 
+// A benchmark excluded from a run by a "benchmark:skip" or
+// "benchmark:goos"/"benchmark:arch" directive
+type SkippedBenchmark struct {
+	Name   string
+	Reason string
+}
+
+
+/*
+ *******************************************************************************
+ *                              Package Variables                              *
+ *******************************************************************************
+*/
+
+
+// Serializes the CPU-sensitive part of a benchmark run (evaluate_benchmark
+// pins the process to CHRT FIFO priority 99 and measures wall-clock time via
+// perf stat); compilation is safe to run concurrently, but only one
+// benchmark may occupy the CPU at a time or runtime figures become meaningless
+var evaluation_mutex sync.Mutex
+
 
 /*
  *******************************************************************************
@@ -120,8 +160,158 @@ func get_files_by_suffix (directory, suffix string) ([]string, error) {
 	return bag, nil
 }
 
-// Returns a compile command for the given directory 
-func get_compile_command (compiler, name, src_dir, bin_dir string) (*exec.Cmd, error) {
+// Constraints declared via "benchmark:*" directives in a benchmark's source,
+// mirroring the "// skip" / build-tag convention in Go's test/run.go
+type benchmark_constraints struct {
+	Skip        bool
+	SkipReason  string
+	GOOS        []string
+	GOARCH      []string
+	ExpectFail  bool
+	ExpectIssue string
+}
+
+var benchmark_directive_exp = regexp.MustCompile(`^//\s*benchmark:(\S+)\s*(.*)$`)
+
+// Parses "benchmark:*" directives out of the leading comment block (up to
+// the first blank line, matching run.go's rule) of a single source file.
+// Recognised directives: "benchmark:skip reason=...", "benchmark:goos
+// <goos,...>", "benchmark:arch <goarch,...>", and "benchmark:expect-fail
+// issue=..."
+func parse_benchmark_directives (c_file_path string) (benchmark_constraints, error) {
+	var constraints benchmark_constraints
+
+	file, err := os.Open(c_file_path)
+	if nil != err {
+		return constraints, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		trimmed := strings.TrimSpace(scanner.Text())
+
+		// Stop at the first blank line
+		if len(trimmed) == 0 {
+			break
+		}
+
+		matches := benchmark_directive_exp.FindStringSubmatch(trimmed)
+		if len(matches) < 3 {
+			continue
+		}
+
+		directive, args := matches[1], strings.TrimSpace(matches[2])
+		switch directive {
+		case "skip":
+			constraints.Skip = true
+			constraints.SkipReason = strings.TrimPrefix(args, "reason=")
+		case "goos":
+			constraints.GOOS = strings.Split(args, ",")
+		case "arch":
+			constraints.GOARCH = strings.Split(args, ",")
+		case "expect-fail":
+			constraints.ExpectFail = true
+			constraints.ExpectIssue = strings.TrimPrefix(args, "issue=")
+		}
+	}
+
+	return constraints, scanner.Err()
+}
+
+// Returns true if target appears in values
+func contains_string (values []string, target string) bool {
+	for _, v := range values {
+		if v == target {
+			return true
+		}
+	}
+	return false
+}
+
+// Aggregates the "benchmark:*" directives declared across all .c files in
+// directory into a single set of constraints
+func benchmark_constraints_for (directory string) (benchmark_constraints, error) {
+	var merged benchmark_constraints
+
+	c_files, err := get_files_by_suffix(directory, ".c")
+	if nil != err {
+		return merged, err
+	}
+
+	for _, c_file := range c_files {
+		constraints, err := parse_benchmark_directives(c_file)
+		if nil != err {
+			return merged, err
+		}
+		if constraints.Skip {
+			merged.Skip = true
+			merged.SkipReason = constraints.SkipReason
+		}
+		if len(constraints.GOOS) > 0 {
+			merged.GOOS = constraints.GOOS
+		}
+		if len(constraints.GOARCH) > 0 {
+			merged.GOARCH = constraints.GOARCH
+		}
+		if constraints.ExpectFail {
+			merged.ExpectFail = true
+			merged.ExpectIssue = constraints.ExpectIssue
+		}
+	}
+
+	return merged, nil
+}
+
+// Returns false if constraints restrict the benchmark to a GOOS/GOARCH
+// other than the one currently running
+func constraints_match_platform (constraints benchmark_constraints) bool {
+	if len(constraints.GOOS) > 0 && !contains_string(constraints.GOOS, runtime.GOOS) {
+		return false
+	}
+	if len(constraints.GOARCH) > 0 && !contains_string(constraints.GOARCH, runtime.GOARCH) {
+		return false
+	}
+	return true
+}
+
+// Reads a fallback expected-failure list from path: one benchmark name per
+// line, optionally followed by "issue=...". A missing file is not an error,
+// it simply means no fallback entries are declared
+func read_expect_fail_list (list_path string) (map[string]string, error) {
+	entries := make(map[string]string)
+
+	file, err := os.Open(list_path)
+	if nil != err {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return entries, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		issue := ""
+		for _, f := range fields[1:] {
+			if strings.HasPrefix(f, "issue=") {
+				issue = strings.TrimPrefix(f, "issue=")
+			}
+		}
+		entries[fields[0]] = issue
+	}
+
+	return entries, scanner.Err()
+}
+
+// Returns a compile command for the given directory
+func get_compile_command (ctx context.Context, compiler, name, src_dir, bin_dir string) (*exec.Cmd, error) {
 	var args []string = []string{}
 
 	// Create and insert executable file name (bin_dir/name)
@@ -142,14 +332,40 @@ func get_compile_command (compiler, name, src_dir, bin_dir string) (*exec.Cmd, e
 		return nil, errors.New("No source files found to compile")
 	}
 
-	return exec.Command(compiler, args...), nil
+	return exec.CommandContext(ctx, compiler, args...), nil
+}
+
+// Runs cmd to completion, killing its entire process group if ctx is
+// cancelled or its deadline elapses first. A plain process kill would leave
+// behind grandchildren (perf stat spawns a child, for instance), so the
+// whole group started by cmd is signalled together
+func run_in_process_group (ctx context.Context, cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); nil != err {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func () {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return ctx.Err()
+	}
 }
 
-// Executes a command through a fork and exec
-func compile_benchmark (cfg Configuration, benchmark *Benchmark, compiler string) error {
+// Executes a command through a fork and exec, bounded by ctx
+func compile_benchmark (ctx context.Context, cfg Configuration, benchmark *Benchmark, compiler string) error {
 
 	// Obtain the compile command
-	cmd, err := get_compile_command(compiler, benchmark.Name, benchmark.Path, cfg.Bin)
+	cmd, err := get_compile_command(ctx, compiler, benchmark.Name, benchmark.Path, cfg.Bin)
 	if nil != err {
 		return err
 	}
@@ -158,54 +374,52 @@ func compile_benchmark (cfg Configuration, benchmark *Benchmark, compiler string
 	cmd.Env = os.Environ()
 
 	// Execute the command
-	return cmd.Run()
+	return run_in_process_group(ctx, cmd)
 }
 
-// Runs perf stat on executable in directory. Results placed in output directory
-func evaluate_benchmark (benchmark *Benchmark, cfg Configuration, repeats int) error {
-	var exists_executable bool 
+// Runs perf stat once on the benchmark's executable and returns the
+// measured duration_time sample, in ns. Repetition is handled by the
+// caller: rather than perf's own --repeat=N, which runs the same binary
+// back-to-back (a worst case for cache/branch-predictor warmup bias and
+// thermal drift), callers take one sample at a time and interleave samples
+// across benchmarks
+func evaluate_benchmark (ctx context.Context, benchmark *Benchmark, cfg Configuration) (float64, error) {
+	var exists_executable bool
 	var err error
-	var cmd *exec.Cmd
-
-	// Create output file
-	output_file_name := benchmark.Name + ".txt"
-	output_file_path := path(cfg.Stats, output_file_name)
-	args := []string{"chrt", "-f", "99", "perf", "stat", "-o", output_file_path, "-e", "duration_time"}
 
 	// Locate the executable
 	exists_executable, err = directory_contains_file(benchmark.Name, cfg.Bin)
 	if nil != err {
-		return errors.New("Unable to search directory \"" + cfg.Bin+ "\": " + err.Error())
+		return 0.0, errors.New("Unable to search directory \"" + cfg.Bin+ "\": " + err.Error())
 	}
 
 	// If the file doesn't exist
 	if !exists_executable {
-		return errors.New("Executable \"" + benchmark.Name + "\" not found in " + cfg.Bin)
+		return 0.0, errors.New("Executable \"" + benchmark.Name + "\" not found in " + cfg.Bin)
 	}
 
-	// Append repeat count
-	args = append(args, fmt.Sprintf("--repeat=%d", repeats))
-
-	// Append executable name
-	args = append(args, path(cfg.Bin, benchmark.Name))
+	// perf stat writes its report to a scratch file; it is parsed and
+	// discarded immediately, since the durable record is the samples file
+	scratch_file_path := path(cfg.Stats, benchmark.Name + ".perf.txt")
+	args := []string{"chrt", "-f", "99", "perf", "stat", "-o", scratch_file_path, "-e", "duration_time", path(cfg.Bin, benchmark.Name)}
 
-	// Build command
-	cmd = exec.Command("sudo", args...)
+	cmd := exec.CommandContext(ctx, "sudo", args...)
 	cmd.Env = os.Environ()
 
-	err = cmd.Run()
-	return err
+	if err = run_in_process_group(ctx, cmd); nil != err {
+		return 0.0, err
+	}
+
+	duration, err := read_duration_ns(scratch_file_path)
+	os.Remove(scratch_file_path)
+	return duration, err
 }
 
-// Extracts perf stat runtime and uncertainty from results file; assigns to benchmark
-func get_benchmark_results (cfg Configuration, benchmark *Benchmark) error {
-	var line []byte                       = []byte{}
-	var match_duration_exp string         = "([0-9],?)+\\s*ns"
-	var match_uncertainty_exp string      = "[0-9]+.[0-9]+%"
-	var err error                         = nil
-	var match string                      = ""
+// Extracts the duration_time sample (ns) from a single perf stat report
+func read_duration_ns (perf_output_path string) (float64, error) {
+	var match_duration_exp string = "([0-9],?)+\\s*ns"
 
-	// Inline function returning float 
+	// Inline function returning float
 	get_float := func (match string) float64 {
 		var value float64 = 0.0
 		var filtered []rune = []rune{}
@@ -244,92 +458,213 @@ func get_benchmark_results (cfg Configuration, benchmark *Benchmark) error {
 		}
 	}
 
-	// File path holding the results
-	results_file_path := path(cfg.Stats, benchmark.Name + ".txt")
-
 	// Attempt to open the file
-	file, err := os.Open(results_file_path)
+	file, err := os.Open(perf_output_path)
 	if nil != err {
-		return err
-	} else {
-		defer file.Close()
+		return 0.0, err
 	}
+	defer file.Close()
 
-	// Read lines
+	// Read lines until the duration expression is matched
 	more := true
-	found_params := 0
 	for reader := bufio.NewReader(file); more; {
-		line, err = reader.ReadBytes('\n')
+		line, err := reader.ReadBytes('\n')
 
-		// Register EoF
 		if io.EOF == err {
 			more = false
 			err = nil
 		}
-
-		// Exit on non EoF error
 		if nil != err {
-			return err
+			return 0.0, err
 		}
 
-		// Try matching duration expression
-		match, err = match_exp(string(line), match_duration_exp)
-		if nil != err {
-			continue
-		} else {
-			benchmark.Runtime = get_float(match)
-			found_params++
+		if match, merr := match_exp(string(line), match_duration_exp); nil == merr {
+			return get_float(match), nil
 		}
+	}
 
-		// Try matching uncertainty expression
-		match, err = match_exp(string(line), match_uncertainty_exp)
-		if nil != err {
+	return 0.0, errors.New("Unable to locate duration in \"" + perf_output_path + "\"")
+}
+
+// Appends a single sample (ns) to the benchmark's persisted samples file,
+// one value per line
+func append_benchmark_sample (cfg Configuration, benchmark *Benchmark, sample_ns float64) error {
+	results_file_path := path(cfg.Stats, benchmark.Name + ".txt")
+
+	file, err := os.OpenFile(results_file_path, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0644)
+	if nil != err {
+		return err
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, "%f\n", sample_ns)
+	return err
+}
+
+// Reads the persisted per-run samples for a benchmark (one ns value per
+// line) and assigns the samples plus their mean and standard deviation
+// (expressed as a percent of the mean) to the benchmark
+func get_benchmark_results (cfg Configuration, benchmark *Benchmark) error {
+	results_file_path := path(cfg.Stats, benchmark.Name + ".txt")
+
+	file, err := os.Open(results_file_path)
+	if nil != err {
+		return err
+	}
+	defer file.Close()
+
+	var samples []float64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
 			continue
-		} else {
-			benchmark.Uncertainty = get_float(match)
-			found_params++
 		}
-
-		if found_params >= 2 {
-			break
+		value, err := strconv.ParseFloat(line, 64)
+		if nil != err {
+			return errors.New("Malformed sample \"" + line + "\" in \"" + results_file_path + "\": " + err.Error())
 		}
+		samples = append(samples, value)
+	}
+	if err := scanner.Err(); nil != err {
+		return err
 	}
 
-	// Return error if didn't find params
-	if found_params != 2 {
-		return errors.New("Unable to locate runtime and/or uncertainty!")
+	if len(samples) == 0 {
+		return errors.New("No samples found in \"" + results_file_path + "\"")
+	}
+
+	mean, stddev := mean_and_stddev(samples)
+
+	benchmark.Samples = samples
+	benchmark.Runtime = mean
+	if mean != 0.0 {
+		benchmark.Uncertainty = (stddev / mean) * 100
 	}
 
 	return nil
 }
 
-// If needed, creates the supplied slice of directories as subdirectories
+// If needed, creates the supplied slice of directories (and any missing
+// parent directories, e.g. a shard's "stats/shard-0" subdirectory)
 func make_directories (directories []string) error {
-	var err error = nil
-
-	// Creates directory if necessary
-	make_if_needed := func (name string) error {
-		exists, err := directory_contains_file(name, ".")
-		if nil != err {
+	for _, d := range directories {
+		if err := os.MkdirAll(d, 0777); nil != err {
 			return err
 		}
-		if !exists {
-			err = os.Mkdir(name, 0777)
-		}
-		return err
 	}
+	return nil
+}
 
-	// Create all supplied directories
-	for _, d := range directories {
-		err = make_if_needed(d)
-		if nil != err {
-			return err
+// Computes the arithmetic mean and median of the given values
+func mean_and_median (values []float64) (float64, float64) {
+	if len(values) == 0 {
+		return 0.0, 0.0
+	}
+
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	var sum float64 = 0.0
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+
+	middle := len(sorted) / 2
+	var median float64
+	if len(sorted) % 2 == 0 {
+		median = (sorted[middle-1] + sorted[middle]) / 2
+	} else {
+		median = sorted[middle]
+	}
+
+	return mean, median
+}
+
+// Computes the sample mean and sample standard deviation (n-1 denominator)
+// of the given values. Fewer than two values yields a standard deviation of 0
+func mean_and_stddev (values []float64) (float64, float64) {
+	if len(values) == 0 {
+		return 0.0, 0.0
+	}
+
+	var sum float64 = 0.0
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+
+	if len(values) < 2 {
+		return mean, 0.0
+	}
+
+	var sum_sq_diff float64 = 0.0
+	for _, v := range values {
+		diff := v - mean
+		sum_sq_diff += diff * diff
+	}
+	variance := sum_sq_diff / float64(len(values) - 1)
+
+	return mean, math.Sqrt(variance)
+}
+
+// Returns a shuffled copy of benchmarks, driven by rng, leaving the input
+// slice untouched
+func shuffled_benchmarks (benchmarks []*Benchmark, rng *rand.Rand) []*Benchmark {
+	shuffled := make([]*Benchmark, len(benchmarks))
+	copy(shuffled, benchmarks)
+
+	for i := len(shuffled) - 1; i > 0; i-- {
+		j := rng.Intn(i + 1)
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	}
+
+	return shuffled
+}
+
+// Compiles the benchmark if it isn't already present in cfg.Bin
+func compile_if_needed (ctx context.Context, cfg Configuration, benchmark *Benchmark, compiler string) error {
+	was_compiled, err := directory_contains_file(benchmark.Name, cfg.Bin)
+	if nil != err {
+		return errors.New("Unable to search \"" + cfg.Bin + "\": " + err.Error())
+	}
+	if was_compiled {
+		return nil
+	}
+
+	compile_ctx, cancel := context.WithTimeout(ctx, cfg.CompileTimeout)
+	defer cancel()
+
+	fmt.Printf("Compiling benchmark \"%s\"...\n", benchmark.Name)
+	if err := compile_benchmark(compile_ctx, cfg, benchmark, compiler); nil != err {
+		if context.DeadlineExceeded == compile_ctx.Err() {
+			return errors.New("Problem compiling benchmark: timeout")
 		}
+		return errors.New("Problem compiling benchmark: " + err.Error())
 	}
+	fmt.Println("- Success")
 
 	return nil
 }
 
+// Computes the 32-bit FNV-1a hash of a string. Used to deterministically
+// assign benchmarks to shards by name rather than by slice position, so
+// shards stay reproducible even as benchmarks are added to cfg.Src
+func fnv1a (s string) uint32 {
+	const offset_basis uint32 = 2166136261
+	const prime uint32 = 16777619
+	var hash uint32 = offset_basis
+
+	for i := 0; i < len(s); i++ {
+		hash ^= uint32(s[i])
+		hash *= prime
+	}
+
+	return hash
+}
+
 
 /*
  *******************************************************************************
@@ -343,16 +678,24 @@ func Init_Env (cfg Configuration) error {
 	return make_directories([]string{cfg.Stats, cfg.Bin})
 }
 
-// Creates all benchmarks (expects that directory holds list of benchmark sub-directories)
-func Init_Benchmarks (cfg Configuration) ([]*Benchmark, error) {
+// Creates all benchmarks (expects that directory holds list of benchmark
+// sub-directories). Benchmarks whose leading comment block carries a
+// "benchmark:skip" directive, or a "benchmark:goos"/"benchmark:arch"
+// directive that doesn't match the current runtime.GOOS/GOARCH, are left
+// out of the returned slice and reported instead in the returned
+// []SkippedBenchmark.
+// expect_fail is consulted as a fallback expected-failure list (keyed by
+// benchmark name) for benchmarks without their own expect-fail directive
+func Init_Benchmarks (cfg Configuration, expect_fail map[string]string) ([]*Benchmark, []SkippedBenchmark, error) {
 	var benchmarks []*Benchmark
+	var skipped []SkippedBenchmark
 	var files []os.FileInfo
 	var err error
 
 	// Open the given directory
 	files, err = ioutil.ReadDir(cfg.Src)
 	if nil != err {
-		return benchmarks, err
+		return benchmarks, skipped, err
 	}
 
 	// Create the benchmarks
@@ -365,20 +708,99 @@ func Init_Benchmarks (cfg Configuration) ([]*Benchmark, error) {
 
 		// Assume sub-directory is a benchmark
 		n := file.Name()
-		b := Benchmark{Name: n, Path: path(cfg.Src, n), Runtime: 0.0, Uncertainty: 0.0}
+		p := path(cfg.Src, n)
+
+		constraints, err := benchmark_constraints_for(p)
+		if nil != err {
+			return benchmarks, skipped, errors.New("Unable to read directives for \"" + n + "\": " + err.Error())
+		}
+
+		if constraints.Skip {
+			skipped = append(skipped, SkippedBenchmark{Name: n, Reason: constraints.SkipReason})
+			continue
+		}
+		if !constraints_match_platform(constraints) {
+			skipped = append(skipped, SkippedBenchmark{Name: n, Reason: "GOOS/GOARCH mismatch"})
+			continue
+		}
+
+		b := Benchmark{Name: n, Path: p, Runtime: 0.0, Uncertainty: 0.0}
+		if constraints.ExpectFail {
+			b.ExpectFail = true
+			b.ExpectIssue = constraints.ExpectIssue
+		} else if issue, ok := expect_fail[n]; ok {
+			b.ExpectFail = true
+			b.ExpectIssue = issue
+		}
 		benchmarks = append(benchmarks, &b)
 	}
 
-	return benchmarks, nil
+	return benchmarks, skipped, nil
+}
+
+// Returns true if name belongs to the given shard, out of shards total;
+// hashing the name (not a slice index) means a shard's contents don't shift
+// around just because unrelated benchmarks were added to or removed from
+// cfg.Src
+func shard_contains (name string, shard, shards int) bool {
+	return int(fnv1a(name) % uint32(shards)) == shard
+}
+
+// Returns the subset of benchmarks belonging to the given shard, out of
+// shards total, mirroring the sharding scheme in Go's test/run.go. A
+// non-positive shards disables sharding and returns benchmarks unchanged
+func ShardFilter (benchmarks []*Benchmark, shard, shards int) []*Benchmark {
+	var filtered []*Benchmark
+
+	if shards <= 0 {
+		return benchmarks
+	}
+
+	for _, b := range benchmarks {
+		if shard_contains(b.Name, shard, shards) {
+			filtered = append(filtered, b)
+		}
+	}
+
+	return filtered
+}
+
+// Returns the subset of skipped_benchmarks belonging to the given shard, out
+// of shards total, using the same name-based hash as ShardFilter. Directive
+// skips never reach ShardFilter (Init_Benchmarks excludes them from the
+// benchmarks slice before returning), so without this, a shard's -summary
+// would report the skip count for the entire benchmark tree rather than
+// this shard's slice of it. A non-positive shards disables sharding and
+// returns skipped_benchmarks unchanged
+func ShardFilterSkipped (skipped_benchmarks []SkippedBenchmark, shard, shards int) []SkippedBenchmark {
+	var filtered []SkippedBenchmark
+
+	if shards <= 0 {
+		return skipped_benchmarks
+	}
+
+	for _, s := range skipped_benchmarks {
+		if shard_contains(s.Name, shard, shards) {
+			filtered = append(filtered, s)
+		}
+	}
+
+	return filtered
 }
 
-// Returns a slice of all benchmarks needing evaluation (those without results)
-func Get_Unevaluated_Benchmarks (cfg Configuration, benchmarks []*Benchmark) ([]*Benchmark, error) {
+// Returns a slice of all benchmarks needing evaluation: those without a
+// results file, and those whose results file exists but holds fewer than
+// repeats samples. The latter happens when a prior run was interrupted
+// (Ctrl-C, or a per-phase -timeout) mid-pass, persisting some but not all of
+// its samples; without this check, that partial file would be mistaken for
+// a complete result and the benchmark would never be topped up or
+// re-checked for an unexpected pass
+func Get_Unevaluated_Benchmarks (cfg Configuration, benchmarks []*Benchmark, repeats int) ([]*Benchmark, error) {
 	var unevaluated_benchmarks []*Benchmark
 	var exists_file bool
 	var err error
 
-	// For each benchmark, determine whether a results file exists
+	// For each benchmark, determine whether a complete results file exists
 	for _, b := range benchmarks {
 
 		// Attempt to locate file in directory
@@ -396,96 +818,377 @@ func Get_Unevaluated_Benchmarks (cfg Configuration, benchmarks []*Benchmark) ([]
 			continue
 		}
 
-		// Otherwise read in and set results
+		// Otherwise read in whatever samples are present
 		err = get_benchmark_results(cfg, b)
 		if nil != err {
 			return unevaluated_benchmarks, errors.New("Unable to read results: " + err.Error())
 		}
+
+		// A results file left behind by an interrupted run holds fewer than
+		// repeats samples; treat it the same as missing, so the benchmark
+		// gets topped up (and isn't silently dropped from expect-fail checks)
+		if len(b.Samples) < repeats {
+			unevaluated_benchmarks = append(unevaluated_benchmarks, b)
+		}
 	}
 
 	return unevaluated_benchmarks, nil
 }
 
-// Evaluates the given benchmark and reads in the results
-func Evaluate_Benchmark (compiler string, cfg Configuration, repeats int, benchmark *Benchmark) error {
-	var was_compiled bool = false
-	var err error
+// A single benchmark's results in a form suitable for JSON/CSV serialization
+type benchmark_result_record struct {
+	Name           string  `json:"name"`
+	RuntimeNs      float64 `json:"runtime_ns"`
+	UncertaintyPct float64 `json:"uncertainty_pct"`
+	Repeats        int     `json:"repeats"`
+	Compiler       string  `json:"compiler"`
+	Path           string  `json:"path"`
+	Timestamp      string  `json:"timestamp"`
+}
 
-	// Determine if compile is needed
-	was_compiled, err = directory_contains_file(benchmark.Name, cfg.Bin)
+// Writes benchmark results to w in the requested format ("json", "csv", or
+// "text"), so a run can be piped into jq/pandas or diffed against another
+// commit's results. The timestamp on every record is the current UTC time
+func Emit_Results (w io.Writer, benchmarks []*Benchmark, format string) error {
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+
+	switch format {
+	case "json":
+		records := make([]benchmark_result_record, 0, len(benchmarks))
+		for _, b := range benchmarks {
+			records = append(records, benchmark_result_record{
+				Name:           b.Name,
+				RuntimeNs:      b.Runtime,
+				UncertaintyPct: b.Uncertainty,
+				Repeats:        b.Repeats,
+				Compiler:       b.Compiler,
+				Path:           b.Path,
+				Timestamp:      timestamp,
+			})
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(records)
+
+	case "csv":
+		writer := csv.NewWriter(w)
+		header := []string{"name", "runtime_ns", "uncertainty_pct", "repeats", "compiler", "path", "timestamp"}
+		if err := writer.Write(header); nil != err {
+			return err
+		}
+		for _, b := range benchmarks {
+			row := []string{
+				b.Name,
+				fmt.Sprintf("%f", b.Runtime),
+				fmt.Sprintf("%f", b.Uncertainty),
+				fmt.Sprintf("%d", b.Repeats),
+				b.Compiler,
+				b.Path,
+				timestamp,
+			}
+			if err := writer.Write(row); nil != err {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
 
-	// Return on directory error
-	if nil != err {
-		return errors.New("Unable to search \"" + cfg.Bin + "\": " + err.Error())
+	case "text":
+		for _, b := range benchmarks {
+			if _, err := fmt.Fprintf(w, "%16s\t\t\t%.2f ns\t\t\t%.2f%%\n", b.Name, b.Runtime, b.Uncertainty); nil != err {
+				return err
+			}
+		}
+		return nil
 	}
 
-	// If the benchmark must be compiled, then compile it now
-	if !was_compiled {
-		fmt.Printf("Compiling benchmark \"%s\"...\n", benchmark.Name)
-		err = compile_benchmark(cfg, benchmark, compiler)
+	return errors.New("Unknown results format \"" + format + "\"")
+}
+
+// Prints aggregate counts over a benchmark run: how many were evaluated this
+// time, how many were cached (already had results from a prior run), how
+// many were excluded by a benchmark:skip/goos/arch directive, how many
+// failed, and the mean/median runtime across benchmarks that actually have
+// samples (benchmarks without samples, such as never-evaluated ones or ones
+// that failed before their first sample, are left out, since their Runtime
+// is still the zero-value set by Init_Benchmarks; a benchmark that failed
+// after taking some samples is included).
+// excluded is the count of directive-skipped benchmarks (see Init_Benchmarks);
+// it is distinct from "cached", which counts benchmarks that do have results
+// but weren't re-run this session
+func Print_Summary (w io.Writer, benchmarks, unevaluated []*Benchmark, errs []error, excluded int) error {
+	var failed int = 0
+	var runtimes []float64
+
+	for _, err := range errs {
+		if nil != err {
+			failed++
+		}
 	}
 
-	// If the benchmark was compiled and an error occurred
-	if nil != err {
-		return errors.New("Problem compiling benchmark: " + err.Error())
-	} else {
-		fmt.Println("- Success")
+	// Benchmarks that were never sampled (never evaluated, or failed before
+	// their first sample) still carry the zero-value Runtime set in
+	// Init_Benchmarks; only fold in benchmarks that
+	// actually have samples backing their Runtime figure
+	for _, b := range benchmarks {
+		if len(b.Samples) > 0 {
+			runtimes = append(runtimes, b.Runtime)
+		}
 	}
 
-	// Evaluate the benchmark
-	fmt.Printf("Evaluating benchmark \"%s\"...\n", benchmark.Name)
-	err = evaluate_benchmark(benchmark, cfg, repeats)
-	if nil != err {
-		return errors.New("Problem evaluating benchmark: " + err.Error())
-	} else {
-		fmt.Println("- Success")
+	evaluated := len(unevaluated) - failed
+	cached := len(benchmarks) - len(unevaluated)
+	mean, median := mean_and_median(runtimes)
+
+	_, err := fmt.Fprintf(w, "Evaluated: %d, Cached: %d, Excluded: %d, Failed: %d, Mean: %.2f ns, Median: %.2f ns\n",
+		evaluated, cached, excluded, failed, mean, median)
+	return err
+}
+
+// Compiles and evaluates the given benchmarks with shuffled, interleaved
+// sampling: instead of running one benchmark repeats times back-to-back
+// (perf's --repeat, a worst case for cache/branch-predictor warmup bias
+// and thermal drift across a long directory), it performs repeats outer
+// passes, each shuffling the benchmark order (seeded by seed, for
+// reproducibility) before taking exactly one sample of every benchmark.
+// Compilation runs across a pool of parallelism workers; evaluation stays
+// serialized via evaluation_mutex. Errors are returned in a slice
+// positioned to match benchmarks
+func Run_Benchmarks (ctx context.Context, compiler string, cfg Configuration, repeats, parallelism int, seed int64, benchmarks []*Benchmark) []error {
+	var errs []error = make([]error, len(benchmarks))
+
+	if parallelism < 1 {
+		parallelism = 1
 	}
 
-	// Read in the results
-	err = get_benchmark_results(cfg, benchmark)
-	if nil != err {
-		return errors.New("Unable to read results for " + benchmark.Name + ": " + err.Error())
+	// Compile every benchmark first, in parallel; this is pure CPU work
+	jobs := make(chan int, len(benchmarks))
+	for i := range benchmarks {
+		jobs <- i
+	}
+	close(jobs)
+
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func () {
+			defer wg.Done()
+			for i := range jobs {
+				if nil != ctx.Err() {
+					errs[i] = ctx.Err()
+					continue
+				}
+				errs[i] = compile_if_needed(ctx, cfg, benchmarks[i], compiler)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Map each benchmark back to its position, so shuffled passes can still
+	// record errors and samples in the original slice order
+	index_by_benchmark := make(map[*Benchmark]int, len(benchmarks))
+	for i, b := range benchmarks {
+		index_by_benchmark[b] = i
+		b.Compiler = compiler
+		b.Repeats = repeats
 	}
 
-	return nil
+	// Evaluate: repeats outer passes, each in a freshly shuffled order. A
+	// cancelled ctx (Ctrl-C, or the caller tearing the run down) stops
+	// scheduling further samples; in-flight ones are killed by evaluate_benchmark
+	rng := rand.New(rand.NewSource(seed))
+	for pass := 0; pass < repeats && nil == ctx.Err(); pass++ {
+		for _, b := range shuffled_benchmarks(benchmarks, rng) {
+			if nil != ctx.Err() {
+				break
+			}
+
+			i := index_by_benchmark[b]
+			if nil != errs[i] {
+				continue
+			}
+
+			eval_ctx, cancel := context.WithTimeout(ctx, cfg.EvalTimeout)
+
+			evaluation_mutex.Lock()
+			sample, err := evaluate_benchmark(eval_ctx, b, cfg)
+			evaluation_mutex.Unlock()
+
+			timed_out := context.DeadlineExceeded == eval_ctx.Err()
+			cancel()
+
+			if nil != err {
+				if timed_out {
+					errs[i] = errors.New("Problem evaluating benchmark: timeout")
+				} else {
+					errs[i] = errors.New("Problem evaluating benchmark: " + err.Error())
+				}
+				continue
+			}
+
+			if err := append_benchmark_sample(cfg, b, sample); nil != err {
+				errs[i] = errors.New("Unable to persist sample for " + b.Name + ": " + err.Error())
+				continue
+			}
+			b.Samples = append(b.Samples, sample)
+		}
+	}
+
+	// Compute aggregate stats from the samples gathered this run
+	for _, b := range benchmarks {
+		if len(b.Samples) == 0 {
+			continue
+		}
+		mean, stddev := mean_and_stddev(b.Samples)
+		b.Runtime = mean
+		if mean != 0.0 {
+			b.Uncertainty = (stddev / mean) * 100
+		}
+	}
+
+	return errs
 }
 
 func main () {
 	var benchmarks []*Benchmark
-	var unevaluated []*Benchmark 
-	var err error 
+	var unevaluated []*Benchmark
+	var err error
+	var errs []error
+
+	// Flags (mirroring the -n / -v / -shard / -shards pattern in Go's test/run.go)
+	n_flag := flag.Int("n", 1, "number of parallel workers to compile with; evaluation always runs one benchmark at a time")
+	v_flag := flag.Bool("v", false, "verbose output; forces parallelism to 1")
+	shard_flag := flag.Int("shard", 0, "shard index to evaluate (0-based); used with -shards")
+	shards_flag := flag.Int("shards", 0, "total number of shards to split the benchmark set across; 0 disables sharding")
+	format_flag := flag.String("format", "text", "results output format: \"text\", \"json\", or \"csv\"")
+	summary_flag := flag.Bool("summary", false, "print aggregate evaluated/cached/excluded/failed counts and mean/median runtime")
+	shuffle_flag := flag.Int64("shuffle", -1, "seed for shuffling benchmark order between repeats; -1 picks a random seed")
+	show_skips_flag := flag.Bool("show_skips", false, "report benchmarks skipped by a benchmark:skip/goos/arch directive")
+	timeout_flag := flag.Duration("timeout", 5 * time.Minute, "maximum duration allowed for each compile, and for each single evaluation run (one sample), of a benchmark")
+	flag.Parse()
+
+	// Reject an out-of-range -shard before it silently turns into an empty
+	// benchmark set (ShardFilter simply finds no match against [0, shards)),
+	// which would otherwise look like "all benchmarks passed" with zero
+	// evaluated
+	if *shards_flag > 0 && (*shard_flag < 0 || *shard_flag >= *shards_flag) {
+		log.Fatalf("-shard %d is out of range for -shards %d; must satisfy 0 <= shard < shards", *shard_flag, *shards_flag)
+	}
+
+	// Verbose mode runs strictly serially, so output isn't interleaved
+	parallelism := *n_flag
+	if *v_flag {
+		parallelism = 1
+	}
 
-	// Setup the configuration
-	cfg := Configuration{Src: "tacle-bench/bench/sequential", Stats: "stats", Bin: "bin"}
+	// A single root context that Ctrl-C cancels, cleanly tearing down any
+	// in-flight children (compile_if_needed/evaluate_benchmark kill their
+	// whole process group when it's cancelled)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sig_chan := make(chan os.Signal, 1)
+	signal.Notify(sig_chan, os.Interrupt)
+	go func () {
+		<-sig_chan
+		cancel()
+	}()
+
+	// A deterministic seed (printed here, as run.go does for -shuffle) makes
+	// the interleaved ordering reproducible across runs
+	seed := *shuffle_flag
+	if seed < 0 {
+		seed = time.Now().UnixNano()
+	}
+	fmt.Printf("Shuffle seed: %d\n", seed)
+
+	// Setup the configuration. When sharding, each shard gets its own stats
+	// subdirectory so results from parallel shards can be merged without
+	// collision
+	cfg := Configuration{
+		Src:            "tacle-bench/bench/sequential",
+		Stats:          "stats",
+		Bin:            "bin",
+		CompileTimeout: *timeout_flag,
+		EvalTimeout:    *timeout_flag,
+	}
+	if *shards_flag > 0 {
+		cfg.Stats = path(cfg.Stats, fmt.Sprintf("shard-%d", *shard_flag))
+	}
 
 	// Init environment
 	if err := Init_Env(cfg); nil != err {
 		log.Fatal(err.Error())
 	}
 
+	// Fallback expected-failure list, consulted for benchmarks without their
+	// own "benchmark:expect-fail" directive
+	expect_fail, err := read_expect_fail_list("expect_fail.txt")
+	if nil != err {
+		log.Fatal(err.Error())
+	}
+
 	// Init benchmarks
-	benchmarks, err = Init_Benchmarks(cfg)
+	var skipped []SkippedBenchmark
+	benchmarks, skipped, err = Init_Benchmarks(cfg, expect_fail)
 	if nil != err {
 		log.Fatal(err.Error())
 	}
+	// Restrict to this shard's subset of benchmarks, and of directive-skipped
+	// benchmarks, so -show_skips/-summary report on this shard alone
+	if *shards_flag > 0 {
+		benchmarks = ShardFilter(benchmarks, *shard_flag, *shards_flag)
+		skipped = ShardFilterSkipped(skipped, *shard_flag, *shards_flag)
+	}
 
-	// Extract any unevaluated benchmarks
-	unevaluated, err = Get_Unevaluated_Benchmarks(cfg, benchmarks)
+	if *show_skips_flag {
+		for _, s := range skipped {
+			fmt.Printf("SKIP\t%s\t%s\n", s.Name, s.Reason)
+		}
+	}
+
+	// Number of interleaved samples to take per benchmark
+	const repeats = 10
+
+	// Extract any unevaluated benchmarks (missing or incomplete results)
+	unevaluated, err = Get_Unevaluated_Benchmarks(cfg, benchmarks, repeats)
 	if nil != err {
 		log.Fatal(err.Error())
 	}
 
-	// Evaluate all unevaluted benchmarks
-	for _, b := range unevaluated {
-		err = Evaluate_Benchmark("cc", cfg, 10, b)
+	// Evaluate all unevaluated benchmarks with shuffled, interleaved
+	// sampling across the worker pool. A failure in one benchmark doesn't
+	// stop the others; failures are just reported
+	errs = Run_Benchmarks(ctx, "cc", cfg, repeats, parallelism, seed, unevaluated)
+	for i, err := range errs {
 		if nil != err {
+			log.Printf("Problem evaluating benchmark \"%s\": %s", unevaluated[i].Name, err.Error())
+		}
+	}
+
+	// Emit results in the requested format
+	if err := Emit_Results(os.Stdout, benchmarks, *format_flag); nil != err {
+		log.Fatal(err.Error())
+	}
+
+	// Optionally print an aggregate summary of the run
+	if *summary_flag {
+		if err := Print_Summary(os.Stdout, benchmarks, unevaluated, errs, len(skipped)); nil != err {
 			log.Fatal(err.Error())
 		}
 	}
 
-	// Print benchmarks
-	for _, b := range benchmarks {
-		fmt.Printf("%16s\t\t\t%.2f ns\t\t\t%.2f%%\n", b.Name, b.Runtime, b.Uncertainty)
+	// Benchmarks marked expect-fail that actually succeeded are unexpected
+	// passes; report them and fail the run so they get noticed and re-triaged
+	unexpected_pass := false
+	for i, b := range unevaluated {
+		if b.ExpectFail && nil == errs[i] {
+			fmt.Printf("UNEXPECTED PASS\t%s\t%s\n", b.Name, b.ExpectIssue)
+			unexpected_pass = true
+		}
+	}
+	if unexpected_pass {
+		os.Exit(1)
 	}
 
 }
\ No newline at end of file
@@ -0,0 +1,175 @@
+package benchmark
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"os"
+	"testing"
+)
+
+// fnv1a is load-bearing for ShardFilter: shard assignment must stay stable
+// across runs and across unrelated changes to cfg.Src, so the hash itself
+// is pinned against known FNV-1a (32-bit) vectors
+func TestFnv1a (t *testing.T) {
+	cases := []struct {
+		in   string
+		want uint32
+	}{
+		{"", 2166136261},
+		{"a", 0xe40c292c},
+		{"foobar", 0xbf9cf968},
+	}
+
+	for _, c := range cases {
+		if got := fnv1a(c.in); got != c.want {
+			t.Errorf("fnv1a(%q) = %#x, want %#x", c.in, got, c.want)
+		}
+	}
+}
+
+// mean_and_stddev backs the Runtime/Uncertainty figures in -summary and
+// Emit_Results, so check it against known sample statistics (n-1 denominator)
+func TestMeanAndStddev (t *testing.T) {
+	if mean, stddev := mean_and_stddev(nil); mean != 0.0 || stddev != 0.0 {
+		t.Errorf("mean_and_stddev(nil) = (%v, %v), want (0, 0)", mean, stddev)
+	}
+
+	if mean, stddev := mean_and_stddev([]float64{42.0}); mean != 42.0 || stddev != 0.0 {
+		t.Errorf("mean_and_stddev of a single value = (%v, %v), want (42, 0)", mean, stddev)
+	}
+
+	values := []float64{2, 4, 4, 4, 5, 5, 7, 9}
+	wantMean, wantStddev := 5.0, 2.138089935
+	mean, stddev := mean_and_stddev(values)
+	if mean != wantMean {
+		t.Errorf("mean_and_stddev mean = %v, want %v", mean, wantMean)
+	}
+	if math.Abs(stddev - wantStddev) > 1e-6 {
+		t.Errorf("mean_and_stddev stddev = %v, want %v", stddev, wantStddev)
+	}
+}
+
+// A benchmark that failed or was never evaluated keeps the zero-value
+// Runtime set by Init_Benchmarks; Print_Summary must not let that drag down
+// the reported mean/median
+func TestPrintSummaryExcludesUnsampledRuntimes (t *testing.T) {
+	benchmarks := []*Benchmark{
+		{Name: "ok-1", Runtime: 1000, Samples: []float64{1000}},
+		{Name: "ok-2", Runtime: 1000, Samples: []float64{1000}},
+		{Name: "failed", Runtime: 0, Samples: nil},
+	}
+	unevaluated := []*Benchmark{benchmarks[2]}
+	errs := []error{errors.New("boom")}
+
+	var buf bytes.Buffer
+	if err := Print_Summary(&buf, benchmarks, unevaluated, errs, 0); nil != err {
+		t.Fatalf("Print_Summary returned error: %v", err)
+	}
+
+	want := "Evaluated: 0, Cached: 2, Excluded: 0, Failed: 1, Mean: 1000.00 ns, Median: 1000.00 ns\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Print_Summary output = %q, want %q", got, want)
+	}
+}
+
+// A results file left behind by an interrupted run holds fewer than repeats
+// samples; Get_Unevaluated_Benchmarks must treat it as incomplete rather
+// than mistaking it for a finished result
+func TestGetUnevaluatedBenchmarksToppedUpWhenIncomplete (t *testing.T) {
+	cfg := Configuration{Stats: t.TempDir()}
+
+	complete := &Benchmark{Name: "complete"}
+	partial := &Benchmark{Name: "partial"}
+	missing := &Benchmark{Name: "missing"}
+
+	if err := os.WriteFile(path(cfg.Stats, "complete.txt"), []byte("1.0\n2.0\n3.0\n"), 0644); nil != err {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path(cfg.Stats, "partial.txt"), []byte("1.0\n"), 0644); nil != err {
+		t.Fatal(err)
+	}
+
+	unevaluated, err := Get_Unevaluated_Benchmarks(cfg, []*Benchmark{complete, partial, missing}, 3)
+	if nil != err {
+		t.Fatalf("Get_Unevaluated_Benchmarks returned error: %v", err)
+	}
+
+	names := make(map[string]bool)
+	for _, b := range unevaluated {
+		names[b.Name] = true
+	}
+	if names["complete"] {
+		t.Errorf("benchmark with a complete (3-sample) results file was marked unevaluated")
+	}
+	if !names["partial"] {
+		t.Errorf("benchmark with a partial (1-of-3 sample) results file was not marked unevaluated")
+	}
+	if !names["missing"] {
+		t.Errorf("benchmark with no results file was not marked unevaluated")
+	}
+}
+
+func TestShardFilterSkipped (t *testing.T) {
+	skipped := []SkippedBenchmark{
+		{Name: "alpha", Reason: "skip"},
+		{Name: "bravo", Reason: "skip"},
+		{Name: "charlie", Reason: "skip"},
+		{Name: "delta", Reason: "skip"},
+	}
+
+	// A non-positive shard count disables sharding
+	if got := ShardFilterSkipped(skipped, 0, 0); len(got) != len(skipped) {
+		t.Fatalf("ShardFilterSkipped with shards=0 returned %d entries, want %d", len(got), len(skipped))
+	}
+
+	// Every entry lands in exactly one of the shards, agreeing with
+	// ShardFilter's assignment for a benchmark of the same name
+	const shards = 3
+	seen := make(map[string]int)
+	for shard := 0; shard < shards; shard++ {
+		for _, s := range ShardFilterSkipped(skipped, shard, shards) {
+			seen[s.Name]++
+			if int(fnv1a(s.Name) % shards) != shard {
+				t.Errorf("%q assigned to shard %d, but fnv1a(%q) %% %d = %d", s.Name, shard, s.Name, shards, int(fnv1a(s.Name) % shards))
+			}
+		}
+	}
+	for _, s := range skipped {
+		if seen[s.Name] != 1 {
+			t.Errorf("%q appeared in %d shards, want exactly 1", s.Name, seen[s.Name])
+		}
+	}
+}
+
+func TestShardFilter (t *testing.T) {
+	benchmarks := []*Benchmark{
+		{Name: "alpha"},
+		{Name: "bravo"},
+		{Name: "charlie"},
+		{Name: "delta"},
+	}
+
+	// A non-positive shard count disables sharding
+	if got := ShardFilter(benchmarks, 0, 0); len(got) != len(benchmarks) {
+		t.Fatalf("ShardFilter with shards=0 returned %d benchmarks, want %d", len(got), len(benchmarks))
+	}
+
+	// Every benchmark lands in exactly one of the shards, and assignment is
+	// driven by name (not slice position)
+	const shards = 3
+	seen := make(map[string]int)
+	for shard := 0; shard < shards; shard++ {
+		for _, b := range ShardFilter(benchmarks, shard, shards) {
+			seen[b.Name]++
+			if int(fnv1a(b.Name) % shards) != shard {
+				t.Errorf("%q assigned to shard %d, but fnv1a(%q) %% %d = %d", b.Name, shard, b.Name, shards, int(fnv1a(b.Name) % shards))
+			}
+		}
+	}
+	for _, b := range benchmarks {
+		if seen[b.Name] != 1 {
+			t.Errorf("%q appeared in %d shards, want exactly 1", b.Name, seen[b.Name])
+		}
+	}
+}